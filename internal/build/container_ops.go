@@ -1,48 +1,217 @@
 package build
 
 import (
+	"archive/tar"
 	"bytes"
 	"context"
-	"fmt"
 	"io"
 	"io/ioutil"
 	"os"
+	"path/filepath"
 	"runtime"
 	"strings"
+	"time"
 
 	"github.com/BurntSushi/toml"
 	"github.com/docker/docker/api/types"
-	dcontainer "github.com/docker/docker/api/types/container"
 	"github.com/docker/docker/client"
 	"github.com/pkg/errors"
 
 	"github.com/buildpacks/pack/internal/archive"
 	"github.com/buildpacks/pack/internal/builder"
-	"github.com/buildpacks/pack/internal/container"
 )
 
 type ContainerOperation func(ctrClient client.CommonAPIClient, ctx context.Context, containerID string, stdout, stderr io.Writer) error
 
-// CopyDir copies a local directory (src) to the destination on the container while filtering files and changing it's UID/GID.
-func CopyDir(src, dst string, uid, gid int, fileFilter func(string) bool) ContainerOperation {
+// ChainOperations composes several ContainerOperations into one, running each in order against the same
+// container and stopping at the first error. It lets a phase runner schedule a builder's whole set of
+// copies (app source, stack.toml, buildpack config) as a single step instead of wiring each one up
+// individually.
+//
+// On a Linux container, CopyDir and WriteStackToml notice they're running as part of a chain and write
+// their tar entries into a stream shared by the whole chain instead of each issuing its own
+// CopyToContainer, so N chained copies collapse into a single Docker API round trip. The merged tar is
+// built up in memory before that one call is made, so an error from any operation in the chain means the
+// merged CopyToContainer call is never made, and so a large chain trades some memory for the reduced
+// round trips. A consequence
+// of the merge: those writes only land in the container once every operation in the chain has run, so an
+// operation that isn't itself a CopyDir/WriteStackToml call must not assume an earlier one's files are
+// already on disk. Windows containers still run one helper-container extraction per operation, since
+// each may bind a different destination volume.
+func ChainOperations(ops ...ContainerOperation) ContainerOperation {
+	return func(ctrClient client.CommonAPIClient, ctx context.Context, containerID string, stdout, stderr io.Writer) error {
+		if len(ops) == 0 {
+			return nil
+		}
+
+		info, err := ctrClient.Info(ctx)
+		if err != nil {
+			return err
+		}
+		if info.OSType == "windows" {
+			for _, op := range ops {
+				if err := op(ctrClient, ctx, containerID, stdout, stderr); err != nil {
+					return err
+				}
+			}
+			return nil
+		}
+
+		buf := &bytes.Buffer{}
+		collector := &tarCollector{tw: tar.NewWriter(buf)}
+		chainCtx := withTarCollector(ctx, collector)
+
+		for _, op := range ops {
+			if err := op(ctrClient, chainCtx, containerID, stdout, stderr); err != nil {
+				return err
+			}
+		}
+		if err := collector.tw.Close(); err != nil {
+			return err
+		}
+
+		return copyDir(ctx, ctrClient, containerID, buf)
+	}
+}
+
+// tarCollector lets several operations chained by ChainOperations contribute to one shared tar stream
+// instead of each opening its own connection to the container.
+type tarCollector struct {
+	tw *tar.Writer
+}
+
+// appendTar copies every entry from r into the collector's tar stream.
+func (c *tarCollector) appendTar(r io.Reader) error {
+	tr := tar.NewReader(r)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if err := c.tw.WriteHeader(hdr); err != nil {
+			return err
+		}
+		if _, err := io.Copy(c.tw, tr); err != nil {
+			return err
+		}
+	}
+}
+
+type tarCollectorKey struct{}
+
+func withTarCollector(ctx context.Context, c *tarCollector) context.Context {
+	return context.WithValue(ctx, tarCollectorKey{}, c)
+}
+
+func tarCollectorFromContext(ctx context.Context) (*tarCollector, bool) {
+	c, ok := ctx.Value(tarCollectorKey{}).(*tarCollector)
+	return c, ok
+}
+
+// CopyOption customizes the behavior of CopyDir and WriteStackToml. Most options' zero value preserves
+// pre-existing behavior; the deliberate exception is symlink handling, whose zero value
+// (SymlinkPolicyReject) is a behavior change from before CopyOption existed — see SymlinkPolicyReject.
+type CopyOption func(*copyConfig)
+
+// SymlinkPolicy controls how CopyDir handles symlinks found inside the source directory.
+type SymlinkPolicy int
+
+const (
+	// SymlinkPolicyReject fails CopyDir if src contains a symlink that resolves outside of src. This is
+	// the default, so a source tree pack doesn't control can't use a symlink to make the copy write
+	// outside of dst inside the container.
+	SymlinkPolicyReject SymlinkPolicy = iota
+	// SymlinkPolicyAllow copies symlinks as-is, even if they point outside of src.
+	SymlinkPolicyAllow
+)
+
+type copyConfig struct {
+	windows              WindowsCopyOptions
+	normalizeTimestamps  bool
+	symlinkPolicy        SymlinkPolicy
+	modeOverride         int64
+	uidOffset, gidOffset int
+}
+
+// WithWindowsCopyOptions configures the short-lived helper container used to extract files on Windows
+// hosts. It has no effect on non-Windows hosts.
+func WithWindowsCopyOptions(opts WindowsCopyOptions) CopyOption {
+	return func(c *copyConfig) {
+		c.windows = opts
+	}
+}
+
+// WithNormalizedTimestamps rewrites every copied file's mtime to archive.NormalizedDateTime, so that
+// copying the same source directory produces a bit-for-bit identical layer every time.
+func WithNormalizedTimestamps() CopyOption {
+	return func(c *copyConfig) {
+		c.normalizeTimestamps = true
+	}
+}
+
+// WithSymlinkPolicy overrides the default handling of symlinks that escape the source directory.
+func WithSymlinkPolicy(policy SymlinkPolicy) CopyOption {
+	return func(c *copyConfig) {
+		c.symlinkPolicy = policy
+	}
+}
+
+// WithModeOverride forces every copied file's permission bits to mode instead of preserving what's on
+// disk (e.g. to make a build-time script executable regardless of its mode in the source tree). Pass -1,
+// the default, to preserve each file's original mode; when pack itself runs on Windows, -1 copies a
+// directory source with mode 0777 instead.
+func WithModeOverride(mode int64) CopyOption {
+	return func(c *copyConfig) {
+		c.modeOverride = mode
+	}
+}
+
+// WithUIDGIDOffset shifts every copied file's owning uid and gid by the given offsets on top of the
+// uid/gid CopyDir was called with, for id-mapped containers whose subordinate ID range is the host's
+// uid/gid plus a fixed base.
+func WithUIDGIDOffset(uidOffset, gidOffset int) CopyOption {
+	return func(c *copyConfig) {
+		c.uidOffset = uidOffset
+		c.gidOffset = gidOffset
+	}
+}
+
+func applyCopyOptions(opts []CopyOption) copyConfig {
+	c := copyConfig{modeOverride: -1}
+	for _, opt := range opts {
+		opt(&c)
+	}
+	return c
+}
+
+// CopyDir copies a local directory (src) to the destination on the container while filtering files and
+// changing it's UID/GID.
+func CopyDir(src, dst string, uid, gid int, fileFilter func(string) bool, opts ...CopyOption) ContainerOperation {
+	cfg := applyCopyOptions(opts)
 	return func(ctrClient client.CommonAPIClient, ctx context.Context, containerID string, stdout, stderr io.Writer) error {
 		info, err := ctrClient.Info(ctx)
 		if err != nil {
 			return err
 		}
 		if info.OSType == "windows" {
-			reader, err := createReader(src, winPathToTarPath(dst), uid, gid, fileFilter)
+			reader, err := createReader(src, winPathToTarPath(dst), uid, gid, fileFilter, cfg)
 			if err != nil {
 				return errors.Wrapf(err, "create tar archive from '%s'", src)
 			}
 			defer reader.Close()
-			return copyWindows(ctx, ctrClient, containerID, reader, dst, stdout, stderr)
+			return extractInContainer(ctx, ctrClient, containerID, reader, dst, stdout, stderr, cfg.windows)
 		}
-		reader, err := createReader(src, dst, uid, gid, fileFilter)
+		reader, err := createReader(src, dst, uid, gid, fileFilter, cfg)
 		if err != nil {
 			return errors.Wrapf(err, "create tar archive from '%s'", src)
 		}
 		defer reader.Close()
+		if collector, ok := tarCollectorFromContext(ctx); ok {
+			return collector.appendTar(reader)
+		}
 		return copyDir(ctx, ctrClient, containerID, reader)
 	}
 }
@@ -69,64 +238,86 @@ func copyDir(ctx context.Context, ctrClient client.CommonAPIClient, containerID
 	return err
 }
 
-// copyWindows provides an alternate, Windows container-specific implementation of copyDir.
-// This implementation is needed because copying directly to a mounted volume is currently buggy
-// for Windows containers and does not work. Instead, we perform the copy from inside a container
-// using xcopy.
-// See: https://github.com/moby/moby/issues/40771
-func copyWindows(ctx context.Context, ctrClient client.CommonAPIClient, containerID string, reader io.Reader, dst string, stdout, stderr io.Writer) error {
-	info, err := ctrClient.ContainerInspect(ctx, containerID)
+// statContainerPath issues a HEAD request for path inside the container (Docker's
+// `HEAD /containers/{id}/archive?path=...`) and reports whether it exists alongside its stat info.
+// A missing path is not treated as an error, since callers use it to decide how to create the path.
+func statContainerPath(ctx context.Context, ctrClient client.CommonAPIClient, containerID, path string) (types.ContainerPathStat, bool, error) {
+	stat, err := ctrClient.ContainerStatPath(ctx, containerID, path)
 	if err != nil {
-		return err
+		if client.IsErrNotFound(err) {
+			return types.ContainerPathStat{}, false, nil
+		}
+		return types.ContainerPathStat{}, false, err
+	}
+	return stat, true, nil
+}
+
+// resolveCopyTarget determines the directory that should be bind-mounted into the extractor prep
+// container for dst: dst itself if it's already a directory, otherwise its parent. It replaces the old
+// `.toml`-suffix heuristic with a real stat of the container filesystem, falling back to a stat of dst's
+// parent when dst does not exist yet (e.g. the first time a file is written to a fresh container).
+func resolveCopyTarget(ctx context.Context, ctrClient client.CommonAPIClient, containerID, dst string) (mountDir string, err error) {
+	stat, exists, err := statContainerPath(ctx, ctrClient, containerID, dst)
+	if err != nil {
+		return "", err
+	}
+	if exists {
+		if stat.Mode.IsDir() {
+			return dst, nil
+		}
+		return parentDir(dst), nil
 	}
 
-	fileOrDir := "d"
-	findDst := dst
-	if strings.HasSuffix(dst, ".toml") {
-		fileOrDir = "f"
-		pathElements := strings.Split(dst, `\`)
-		findDst = strings.Join(pathElements[:len(pathElements)-1], `\`) // parent of file
+	parent := parentDir(dst)
+	parentStat, exists, err := statContainerPath(ctx, ctrClient, containerID, parent)
+	if err != nil {
+		return "", err
 	}
+	if !exists || !parentStat.Mode.IsDir() {
+		return "", errors.Errorf("parent of '%s' does not exist in container", dst)
+	}
+	return parent, nil
+}
 
-	mnt, err := findMount(info, findDst)
+// containerPathMatchesContent reports whether dst already exists in the container as a regular file with
+// exactly the given content, so WriteStackToml can skip rewriting a stack.toml that hasn't changed. The
+// size stat is checked first since it's already available from statContainerPath and rules out most
+// changes for free; only a same-size candidate is worth the extra round trip of reading it back and
+// comparing bytes directly, since two stack.toml's of equal length can still differ (e.g. an image
+// digest of the same length swapped for another). A byte-for-byte directory comparison isn't worth the
+// round trips for CopyDir, so this stays scoped to WriteStackToml's single small file.
+func containerPathMatchesContent(ctx context.Context, ctrClient client.CommonAPIClient, containerID, dst string, content []byte) (bool, error) {
+	stat, exists, err := statContainerPath(ctx, ctrClient, containerID, dst)
 	if err != nil {
-		return err
+		return false, err
+	}
+	if !exists || stat.Mode.IsDir() || stat.Size != int64(len(content)) {
+		return false, nil
 	}
 
-	ctr, err := ctrClient.ContainerCreate(ctx,
-		&dcontainer.Config{
-			Image: info.Image,
-			Cmd: []string{
-				"cmd",
-				"/c",
-				fmt.Sprintf(`echo %s|xcopy /e /h /y /c /b c:\windows\%s %s`, fileOrDir, dst[3:], dst),
-			},
-			WorkingDir: "/",
-			User:       windowsContainerAdmin,
-		},
-		&dcontainer.HostConfig{
-			Binds:     []string{fmt.Sprintf("%s:%s", mnt.Name, mnt.Destination)},
-			Isolation: dcontainer.IsolationProcess,
-		},
-		nil, "",
-	)
+	rc, _, err := ctrClient.CopyFromContainer(ctx, containerID, dst)
 	if err != nil {
-		return errors.Wrapf(err, "creating prep container")
+		if client.IsErrNotFound(err) {
+			return false, nil
+		}
+		return false, err
 	}
-	defer ctrClient.ContainerRemove(context.Background(), ctr.ID, types.ContainerRemoveOptions{Force: true})
+	defer rc.Close()
 
-	err = ctrClient.CopyToContainer(ctx, ctr.ID, "/windows", reader, types.CopyToContainerOptions{})
+	tr := tar.NewReader(rc)
+	if _, err := tr.Next(); err != nil {
+		return false, err
+	}
+	existing, err := ioutil.ReadAll(tr)
 	if err != nil {
-		return errors.Wrap(err, "copy app to container")
+		return false, err
 	}
+	return bytes.Equal(existing, content), nil
+}
 
-	return container.Run(
-		ctx,
-		ctrClient,
-		ctr.ID,
-		ioutil.Discard, // Suppress xcopy output
-		stderr,
-	)
+func parentDir(path string) string {
+	pathElements := strings.Split(path, `\`)
+	return strings.Join(pathElements[:len(pathElements)-1], `\`)
 }
 
 func findMount(info types.ContainerJSON, dst string) (types.MountPoint, error) {
@@ -139,7 +330,8 @@ func findMount(info types.ContainerJSON, dst string) (types.MountPoint, error) {
 }
 
 // WriteStackToml writes a `stack.toml` based on the StackMetadata provided to the destination path.
-func WriteStackToml(dstPath string, stack builder.StackMetadata) ContainerOperation {
+func WriteStackToml(dstPath string, stack builder.StackMetadata, opts ...CopyOption) ContainerOperation {
+	cfg := applyCopyOptions(opts)
 	return func(ctrClient client.CommonAPIClient, ctx context.Context, containerID string, stdout, stderr io.Writer) error {
 		buf := &bytes.Buffer{}
 		err := toml.NewEncoder(buf).Encode(stack)
@@ -147,6 +339,12 @@ func WriteStackToml(dstPath string, stack builder.StackMetadata) ContainerOperat
 			return errors.Wrap(err, "marshaling stack metadata")
 		}
 
+		if match, err := containerPathMatchesContent(ctx, ctrClient, containerID, dstPath, buf.Bytes()); err != nil {
+			return err
+		} else if match {
+			return nil
+		}
+
 		tarBuilder := archive.TarBuilder{}
 
 		info, err := ctrClient.Info(ctx)
@@ -157,12 +355,15 @@ func WriteStackToml(dstPath string, stack builder.StackMetadata) ContainerOperat
 			tarBuilder.AddFile(winPathToTarPath(dstPath), 0755, archive.NormalizedDateTime, buf.Bytes())
 			reader := tarBuilder.Reader(archive.DefaultTarWriterFactory())
 			defer reader.Close()
-			return copyWindows(ctx, ctrClient, containerID, reader, dstPath, stdout, stderr)
+			return extractInContainer(ctx, ctrClient, containerID, reader, dstPath, stdout, stderr, cfg.windows)
 		}
 
 		tarBuilder.AddFile(dstPath, 0755, archive.NormalizedDateTime, buf.Bytes())
 		reader := tarBuilder.Reader(archive.DefaultTarWriterFactory())
 		defer reader.Close()
+		if collector, ok := tarCollectorFromContext(ctx); ok {
+			return collector.appendTar(reader)
+		}
 		return ctrClient.CopyToContainer(ctx, containerID, "/", reader, types.CopyToContainerOptions{})
 	}
 }
@@ -171,20 +372,186 @@ func winPathToTarPath(path string) string {
 	return strings.ReplaceAll(path, `\`, "/")[2:] // strip volume, convert slashes
 }
 
-func createReader(src, dst string, uid, gid int, fileFilter func(string) bool) (io.ReadCloser, error) {
+// PathInfo describes the file or directory that was extracted from a container by CopyFromContainer.
+type PathInfo struct {
+	Name  string
+	Size  int64
+	Mode  os.FileMode
+	Mtime time.Time
+}
+
+// CopyFromContainer copies a path (src) out of a container to a local directory (dst), filtering files
+// as they're unpacked. It is the container→host counterpart to CopyDir. If stat is non-nil, it is
+// populated with the path metadata reported by the container runtime so callers can validate what was
+// extracted.
+func CopyFromContainer(src, dst string, fileFilter func(string) bool, stat *PathInfo) ContainerOperation {
+	return func(ctrClient client.CommonAPIClient, ctx context.Context, containerID string, stdout, stderr io.Writer) error {
+		info, err := ctrClient.Info(ctx)
+		if err != nil {
+			return err
+		}
+
+		containerSrc := src
+		if info.OSType == "windows" {
+			containerSrc = tarPathToWinPath(src)
+		}
+
+		reader, pathStat, err := ctrClient.CopyFromContainer(ctx, containerID, containerSrc)
+		if err != nil {
+			return errors.Wrapf(err, "copy '%s' from container", containerSrc)
+		}
+		defer reader.Close()
+
+		if stat != nil {
+			stat.Name = pathStat.Name
+			stat.Size = pathStat.Size
+			stat.Mode = os.FileMode(pathStat.Mode)
+			stat.Mtime = pathStat.Mtime
+		}
+
+		if err := extractTar(reader, dst, fileFilter); err != nil {
+			return errors.Wrapf(err, "extract '%s' to '%s'", containerSrc, dst)
+		}
+
+		return nil
+	}
+}
+
+// extractTar unpacks a tar stream to dst on the host, skipping any entry for which fileFilter returns
+// false. Entries whose name or (for symlinks) link target would resolve outside of dst are rejected,
+// since a container is not a trusted source of paths.
+func extractTar(r io.Reader, dst string, fileFilter func(string) bool) error {
+	tr := tar.NewReader(r)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if fileFilter != nil && !fileFilter(hdr.Name) {
+			continue
+		}
+
+		target, err := safeJoin(dst, hdr.Name)
+		if err != nil {
+			return err
+		}
+
+		switch hdr.Typeflag {
+		case tar.TypeDir:
+			if err := os.MkdirAll(target, os.FileMode(hdr.Mode)); err != nil {
+				return err
+			}
+		case tar.TypeReg:
+			if err := os.MkdirAll(filepath.Dir(target), 0755); err != nil {
+				return err
+			}
+			f, err := os.OpenFile(target, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, os.FileMode(hdr.Mode))
+			if err != nil {
+				return err
+			}
+			if _, err := io.Copy(f, tr); err != nil {
+				f.Close()
+				return err
+			}
+			if err := f.Close(); err != nil {
+				return err
+			}
+		case tar.TypeSymlink:
+			if filepath.IsAbs(hdr.Linkname) {
+				return errors.Errorf("symlink '%s' has an absolute target '%s'", hdr.Name, hdr.Linkname)
+			}
+			if _, err := safeJoin(dst, filepath.Join(filepath.Dir(hdr.Name), hdr.Linkname)); err != nil {
+				return errors.Wrapf(err, "symlink '%s' -> '%s'", hdr.Name, hdr.Linkname)
+			}
+			if err := os.MkdirAll(filepath.Dir(target), 0755); err != nil {
+				return err
+			}
+			if err := os.Symlink(hdr.Linkname, target); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+// safeJoin joins name onto dst and rejects the result if it doesn't stay within dst, guarding against
+// tar entries like "../../etc/passwd" writing outside the extraction directory.
+func safeJoin(dst, name string) (string, error) {
+	cleanDst := filepath.Clean(dst)
+	target := filepath.Join(cleanDst, name)
+	if target != cleanDst && !strings.HasPrefix(target, cleanDst+string(filepath.Separator)) {
+		return "", errors.Errorf("'%s' escapes destination '%s'", name, dst)
+	}
+	return target, nil
+}
+
+// tarPathToWinPath is the inverse of winPathToTarPath: it converts a tar-style forward-slash path
+// into a Windows path rooted at the container's system drive.
+func tarPathToWinPath(path string) string {
+	return `c:\` + strings.ReplaceAll(strings.TrimPrefix(path, "/"), "/", `\`)
+}
+
+func createReader(src, dst string, uid, gid int, fileFilter func(string) bool, cfg copyConfig) (io.ReadCloser, error) {
 	fi, err := os.Stat(src)
 	if err != nil {
 		return nil, err
 	}
 
+	uid += cfg.uidOffset
+	gid += cfg.gidOffset
+
 	if fi.IsDir() {
-		var mode int64 = -1
-		if runtime.GOOS == "windows" {
+		if cfg.symlinkPolicy != SymlinkPolicyAllow {
+			if err := checkSymlinkContainment(src); err != nil {
+				return nil, err
+			}
+		}
+
+		mode := cfg.modeOverride
+		if mode == -1 && runtime.GOOS == "windows" {
 			mode = 0777
 		}
 
-		return archive.ReadDirAsTar(src, dst, uid, gid, mode, false, fileFilter), nil
+		return archive.ReadDirAsTar(src, dst, uid, gid, mode, cfg.normalizeTimestamps, fileFilter), nil
 	}
 
-	return archive.ReadZipAsTar(src, dst, uid, gid, -1, false, fileFilter), nil
+	return archive.ReadZipAsTar(src, dst, uid, gid, cfg.modeOverride, cfg.normalizeTimestamps, fileFilter), nil
+}
+
+// checkSymlinkContainment walks src and rejects any symlink whose target resolves outside of src, so a
+// source tree can't use a symlink to escape dst once it's unpacked inside the container.
+func checkSymlinkContainment(src string) error {
+	absSrc, err := filepath.Abs(src)
+	if err != nil {
+		return err
+	}
+
+	return filepath.Walk(src, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if info.Mode()&os.ModeSymlink == 0 {
+			return nil
+		}
+
+		linkTarget, err := os.Readlink(path)
+		if err != nil {
+			return err
+		}
+		if !filepath.IsAbs(linkTarget) {
+			linkTarget = filepath.Join(filepath.Dir(path), linkTarget)
+		}
+		linkTarget, err = filepath.Abs(linkTarget)
+		if err != nil {
+			return err
+		}
+
+		rel, err := filepath.Rel(absSrc, linkTarget)
+		if err != nil || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+			return errors.Errorf("symlink '%s' resolves outside of '%s'", path, src)
+		}
+		return nil
+	})
 }
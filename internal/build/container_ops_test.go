@@ -0,0 +1,170 @@
+package build
+
+import (
+	"archive/tar"
+	"bytes"
+	"context"
+	"io"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/client"
+	"github.com/pkg/errors"
+)
+
+// writeTestFile writes contents to name inside dir, failing the test on error.
+func writeTestFile(t *testing.T, dir, name, contents string) string {
+	t.Helper()
+	path := filepath.Join(dir, name)
+	if err := os.WriteFile(path, []byte(contents), 0644); err != nil {
+		t.Fatalf("write test file '%s': %s", path, err)
+	}
+	return path
+}
+
+// fakeAPIClient is a minimal client.CommonAPIClient double. Embedding the real interface with a nil
+// value satisfies it at compile time; only the methods exercised by these tests are overridden.
+type fakeAPIClient struct {
+	client.CommonAPIClient
+
+	osType               string
+	copyToContainerCalls int
+	copiedHeaders        []tar.Header
+	statPaths            map[string]types.ContainerPathStat
+	fileContents         map[string][]byte
+}
+
+func (f *fakeAPIClient) Info(ctx context.Context) (types.Info, error) {
+	return types.Info{OSType: f.osType}, nil
+}
+
+// notFoundError satisfies errdefs.ErrNotFound (an interface of just a NotFound() marker method), which
+// client.IsErrNotFound checks for.
+type notFoundError struct{ error }
+
+func (notFoundError) NotFound() {}
+
+func (f *fakeAPIClient) ContainerStatPath(ctx context.Context, containerID, path string) (types.ContainerPathStat, error) {
+	stat, ok := f.statPaths[path]
+	if !ok {
+		return types.ContainerPathStat{}, notFoundError{errors.New("not found: " + path)}
+	}
+	return stat, nil
+}
+
+// CopyFromContainer returns a single-entry tar stream wrapping f.fileContents[srcPath], mirroring how
+// the real docker daemon always answers the archive endpoint with a tar even for a single file.
+func (f *fakeAPIClient) CopyFromContainer(ctx context.Context, containerID, srcPath string) (io.ReadCloser, types.ContainerPathStat, error) {
+	content, ok := f.fileContents[srcPath]
+	if !ok {
+		return nil, types.ContainerPathStat{}, notFoundError{errors.New("not found: " + srcPath)}
+	}
+
+	buf := &bytes.Buffer{}
+	tw := tar.NewWriter(buf)
+	if err := tw.WriteHeader(&tar.Header{Name: filepath.Base(srcPath), Typeflag: tar.TypeReg, Size: int64(len(content)), Mode: 0644}); err != nil {
+		return nil, types.ContainerPathStat{}, err
+	}
+	if _, err := tw.Write(content); err != nil {
+		return nil, types.ContainerPathStat{}, err
+	}
+	if err := tw.Close(); err != nil {
+		return nil, types.ContainerPathStat{}, err
+	}
+	return io.NopCloser(buf), types.ContainerPathStat{}, nil
+}
+
+func (f *fakeAPIClient) CopyToContainer(ctx context.Context, containerID, dstPath string, content io.Reader, opts types.CopyToContainerOptions) error {
+	f.copyToContainerCalls++
+	tr := tar.NewReader(content)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		f.copiedHeaders = append(f.copiedHeaders, *hdr)
+	}
+}
+
+func countingOp(calls *[]string, name string) ContainerOperation {
+	return func(client.CommonAPIClient, context.Context, string, io.Writer, io.Writer) error {
+		*calls = append(*calls, name)
+		return nil
+	}
+}
+
+func TestChainOperations(t *testing.T) {
+	t.Run("merges chained Linux copies into a single CopyToContainer call", func(t *testing.T) {
+		srcDir := t.TempDir()
+		writeTestFile(t, srcDir, "a.txt", "a")
+
+		fake := &fakeAPIClient{osType: "linux"}
+		op := ChainOperations(
+			CopyDir(srcDir, "/dst-a", 0, 0, nil),
+			CopyDir(srcDir, "/dst-b", 0, 0, nil),
+		)
+
+		if err := op(fake, context.Background(), "container-id", io.Discard, io.Discard); err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+		if fake.copyToContainerCalls != 1 {
+			t.Fatalf("want 1 CopyToContainer call, got %d", fake.copyToContainerCalls)
+		}
+	})
+
+	t.Run("runs each operation independently on a Windows container", func(t *testing.T) {
+		fake := &fakeAPIClient{osType: "windows"}
+		var calls []string
+		op := ChainOperations(countingOp(&calls, "one"), countingOp(&calls, "two"))
+
+		if err := op(fake, context.Background(), "container-id", io.Discard, io.Discard); err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+		if !reflect.DeepEqual(calls, []string{"one", "two"}) {
+			t.Fatalf("want operations run in order, got %v", calls)
+		}
+	})
+
+	t.Run("stops at the first error without running later operations", func(t *testing.T) {
+		fake := &fakeAPIClient{osType: "windows"}
+		wantErr := errors.New("boom")
+		var calls []string
+		op := ChainOperations(
+			func(client.CommonAPIClient, context.Context, string, io.Writer, io.Writer) error {
+				calls = append(calls, "one")
+				return wantErr
+			},
+			countingOp(&calls, "two"),
+		)
+
+		err := op(fake, context.Background(), "container-id", io.Discard, io.Discard)
+		if errors.Cause(err) != wantErr {
+			t.Fatalf("want %q, got %q", wantErr, err)
+		}
+		if !reflect.DeepEqual(calls, []string{"one"}) {
+			t.Fatalf("want only the first operation to run, got %v", calls)
+		}
+	})
+
+	t.Run("propagates an error raised while merging Linux copies", func(t *testing.T) {
+		fake := &fakeAPIClient{osType: "linux"}
+		wantErr := errors.New("boom")
+		op := ChainOperations(func(client.CommonAPIClient, context.Context, string, io.Writer, io.Writer) error {
+			return wantErr
+		})
+
+		err := op(fake, context.Background(), "container-id", io.Discard, io.Discard)
+		if errors.Cause(err) != wantErr {
+			t.Fatalf("want %q, got %q", wantErr, err)
+		}
+		if fake.copyToContainerCalls != 0 {
+			t.Fatalf("want no CopyToContainer call after an error, got %d", fake.copyToContainerCalls)
+		}
+	})
+}
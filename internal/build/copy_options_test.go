@@ -0,0 +1,164 @@
+package build
+
+import (
+	"archive/tar"
+	"context"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/buildpacks/pack/internal/archive"
+)
+
+func TestCopyDirSymlinkPolicy(t *testing.T) {
+	for _, tc := range []struct {
+		name    string
+		opts    []CopyOption
+		wantErr bool
+	}{
+		{name: "default policy rejects a symlink that escapes src", wantErr: true},
+		{
+			name:    "SymlinkPolicyAllow copies an escaping symlink as-is",
+			opts:    []CopyOption{WithSymlinkPolicy(SymlinkPolicyAllow)},
+			wantErr: false,
+		},
+	} {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			outsideDir := t.TempDir()
+			srcDir := t.TempDir()
+			if err := os.Symlink(filepath.Join(outsideDir, "target"), filepath.Join(srcDir, "escape")); err != nil {
+				t.Fatalf("create symlink: %s", err)
+			}
+
+			fake := &fakeAPIClient{osType: "linux"}
+			op := CopyDir(srcDir, "/dst", 0, 0, nil, tc.opts...)
+			err := op(fake, context.Background(), "container-id", io.Discard, io.Discard)
+
+			if tc.wantErr && err == nil {
+				t.Fatalf("want an error, got none")
+			}
+			if !tc.wantErr && err != nil {
+				t.Fatalf("unexpected error: %s", err)
+			}
+		})
+	}
+}
+
+func TestCopyDirNormalizedTimestamps(t *testing.T) {
+	for _, tc := range []struct {
+		name       string
+		opts       []CopyOption
+		wantNormal bool
+	}{
+		{name: "without WithNormalizedTimestamps, mtimes are left as-is"},
+		{
+			name:       "WithNormalizedTimestamps rewrites every file's mtime",
+			opts:       []CopyOption{WithNormalizedTimestamps()},
+			wantNormal: true,
+		},
+	} {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			srcDir := t.TempDir()
+			writeTestFile(t, srcDir, "a.txt", "a")
+
+			fake := &fakeAPIClient{osType: "linux"}
+			op := CopyDir(srcDir, "/dst", 0, 0, nil, tc.opts...)
+			if err := op(fake, context.Background(), "container-id", io.Discard, io.Discard); err != nil {
+				t.Fatalf("unexpected error: %s", err)
+			}
+
+			var sawRegularFile bool
+			for _, hdr := range fake.copiedHeaders {
+				if hdr.Typeflag != tar.TypeReg {
+					continue
+				}
+				sawRegularFile = true
+				isNormalized := hdr.ModTime.Equal(archive.NormalizedDateTime)
+				if tc.wantNormal && !isNormalized {
+					t.Fatalf("want mtime normalized to %s, got %s", archive.NormalizedDateTime, hdr.ModTime)
+				}
+				if !tc.wantNormal && isNormalized {
+					t.Fatalf("mtime unexpectedly normalized to %s", archive.NormalizedDateTime)
+				}
+			}
+			if !sawRegularFile {
+				t.Fatalf("expected at least one regular file entry in the copied tar")
+			}
+		})
+	}
+}
+
+func TestCopyDirModeOverride(t *testing.T) {
+	for _, tc := range []struct {
+		name     string
+		opts     []CopyOption
+		wantMode int64
+	}{
+		{name: "without WithModeOverride, the file's own mode is preserved", wantMode: 0600},
+		{
+			name:     "WithModeOverride forces every file's mode",
+			opts:     []CopyOption{WithModeOverride(0755)},
+			wantMode: 0755,
+		},
+	} {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			srcDir := t.TempDir()
+			path := writeTestFile(t, srcDir, "a.txt", "a")
+			if err := os.Chmod(path, 0600); err != nil {
+				t.Fatalf("chmod test file: %s", err)
+			}
+
+			fake := &fakeAPIClient{osType: "linux"}
+			op := CopyDir(srcDir, "/dst", 0, 0, nil, tc.opts...)
+			if err := op(fake, context.Background(), "container-id", io.Discard, io.Discard); err != nil {
+				t.Fatalf("unexpected error: %s", err)
+			}
+
+			var sawRegularFile bool
+			for _, hdr := range fake.copiedHeaders {
+				if hdr.Typeflag != tar.TypeReg {
+					continue
+				}
+				sawRegularFile = true
+				if hdr.Mode != tc.wantMode {
+					t.Fatalf("want mode %o, got %o", tc.wantMode, hdr.Mode)
+				}
+			}
+			if !sawRegularFile {
+				t.Fatalf("expected at least one regular file entry in the copied tar")
+			}
+		})
+	}
+}
+
+func TestCopyDirUIDGIDOffset(t *testing.T) {
+	srcDir := t.TempDir()
+	writeTestFile(t, srcDir, "a.txt", "a")
+
+	fake := &fakeAPIClient{osType: "linux"}
+	op := CopyDir(srcDir, "/dst", 1000, 2000, nil, WithUIDGIDOffset(100000, 200000))
+	if err := op(fake, context.Background(), "container-id", io.Discard, io.Discard); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	var sawRegularFile bool
+	for _, hdr := range fake.copiedHeaders {
+		if hdr.Typeflag != tar.TypeReg {
+			continue
+		}
+		sawRegularFile = true
+		if hdr.Uid != 101000 {
+			t.Fatalf("want uid 101000, got %d", hdr.Uid)
+		}
+		if hdr.Gid != 202000 {
+			t.Fatalf("want gid 202000, got %d", hdr.Gid)
+		}
+	}
+	if !sawRegularFile {
+		t.Fatalf("expected at least one regular file entry in the copied tar")
+	}
+}
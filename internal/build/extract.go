@@ -0,0 +1,133 @@
+package build
+
+import (
+	_ "embed"
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+
+	"github.com/docker/docker/api/types"
+	dcontainer "github.com/docker/docker/api/types/container"
+	"github.com/docker/docker/client"
+	"github.com/pkg/errors"
+
+	"github.com/buildpacks/pack/internal/archive"
+	"github.com/buildpacks/pack/internal/container"
+)
+
+// extractorBinary is the statically-linked extractor built from ./extract, embedded here so prep
+// containers can unpack a tar stream without depending on platform tools like xcopy.
+//
+// extract/extractor_windows_amd64.exe is checked in as a placeholder so `go build` always has a file to
+// embed; running `go generate ./internal/build` overwrites it with the real cross-compiled binary. This
+// is a hard prerequisite for any build whose output is meant to actually copy files on Windows: the
+// release pipeline MUST run `go generate ./internal/build` before `go build`, or the pack binary it
+// produces will embed the placeholder text and fail (or worse, write garbage) the first time
+// extractInContainer runs it inside a helper container. A local `go build` without that step is fine for
+// working on non-Windows code paths, since the placeholder is never executed there.
+//
+//go:generate env GOOS=windows GOARCH=amd64 go build -o extract/extractor_windows_amd64.exe ./extract
+//go:embed extract/extractor_windows_amd64.exe
+var extractorBinary []byte
+
+const extractorContainerPath = `c:\extractor.exe`
+
+// WindowsCopyOptions configures the short-lived helper container used to extract files on Windows. The
+// zero value preserves the previous behavior: process isolation, using the builder image itself as the
+// helper image, and no additional HostConfig overrides.
+type WindowsCopyOptions struct {
+	// Isolation selects the helper container's isolation mode. Hosts that don't support Hyper-V
+	// isolation (or vice versa) can override the IsolationProcess default here.
+	Isolation dcontainer.Isolation
+
+	// HelperImage overrides the image used to run the extractor, so a minimal nanoserver-based image
+	// can be used instead of pulling the (potentially large) builder image just to run it.
+	HelperImage string
+
+	// HostConfig, when non-nil, seeds the helper container's HostConfig (e.g. to set Resources or
+	// NetworkMode) before Binds is appended. An Isolation set on HostConfig directly takes precedence
+	// over Isolation above; otherwise Isolation (or its IsolationProcess default) is used.
+	HostConfig *dcontainer.HostConfig
+}
+
+func (o WindowsCopyOptions) isolation() dcontainer.Isolation {
+	if o.Isolation == "" {
+		return dcontainer.IsolationProcess
+	}
+	return o.Isolation
+}
+
+func (o WindowsCopyOptions) helperImage(defaultImage string) string {
+	if o.HelperImage == "" {
+		return defaultImage
+	}
+	return o.HelperImage
+}
+
+// extractInContainer un-tars reader into dst inside containerID by running the embedded extractor binary
+// in a short-lived helper container that shares dst's volume. It replaces the old xcopy-based copyWindows
+// and is used by CopyDir/WriteStackToml for their Windows branch; the same approach could also cover
+// Linux mounted-volume edge cases in the future, but today CopyDir and WriteStackToml still branch on
+// info.OSType to pick between this function and the direct CopyToContainer path, not just to normalize
+// the destination path.
+func extractInContainer(ctx context.Context, ctrClient client.CommonAPIClient, containerID string, reader io.Reader, dst string, stdout, stderr io.Writer, opts WindowsCopyOptions) error {
+	info, err := ctrClient.ContainerInspect(ctx, containerID)
+	if err != nil {
+		return err
+	}
+
+	findDst, err := resolveCopyTarget(ctx, ctrClient, containerID, dst)
+	if err != nil {
+		return errors.Wrapf(err, "resolve copy target '%s'", dst)
+	}
+
+	mnt, err := findMount(info, findDst)
+	if err != nil {
+		return err
+	}
+
+	hostConfig := dcontainer.HostConfig{}
+	if opts.HostConfig != nil {
+		hostConfig = *opts.HostConfig
+	}
+	hostConfig.Binds = append(hostConfig.Binds, fmt.Sprintf("%s:%s", mnt.Name, mnt.Destination))
+	if hostConfig.Isolation == "" {
+		hostConfig.Isolation = opts.isolation()
+	}
+
+	ctr, err := ctrClient.ContainerCreate(ctx,
+		&dcontainer.Config{
+			Image:      opts.helperImage(info.Image),
+			Cmd:        []string{extractorContainerPath, "-dst", dst},
+			WorkingDir: "/",
+			User:       windowsContainerAdmin,
+		},
+		&hostConfig,
+		nil, "",
+	)
+	if err != nil {
+		return errors.Wrapf(err, "creating prep container")
+	}
+	defer ctrClient.ContainerRemove(context.Background(), ctr.ID, types.ContainerRemoveOptions{Force: true})
+
+	extractorTar := archive.TarBuilder{}
+	extractorTar.AddFile(extractorContainerPath, 0755, archive.NormalizedDateTime, extractorBinary)
+	extractorReader := extractorTar.Reader(archive.DefaultTarWriterFactory())
+	defer extractorReader.Close()
+	if err := ctrClient.CopyToContainer(ctx, ctr.ID, "/windows", extractorReader, types.CopyToContainerOptions{}); err != nil {
+		return errors.Wrap(err, "copy extractor to container")
+	}
+
+	if err := ctrClient.CopyToContainer(ctx, ctr.ID, "/windows", reader, types.CopyToContainerOptions{}); err != nil {
+		return errors.Wrap(err, "copy app to container")
+	}
+
+	return container.Run(
+		ctx,
+		ctrClient,
+		ctr.ID,
+		ioutil.Discard, // Suppress extractor output
+		stderr,
+	)
+}
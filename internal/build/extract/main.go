@@ -0,0 +1,104 @@
+// Command extract is a minimal, dependency-free tar extractor meant to run inside a short-lived helper
+// container. It is built for the target container OS/arch and embedded into the pack binary so that
+// copying files into a container no longer depends on platform-specific tools like xcopy.
+//
+// It reads a tar stream from stdin and writes it to -dst, preserving each entry's mode bits and mtime.
+// It does not preserve uid/gid: today this extractor only ever runs inside Windows containers (see
+// extract.go's extractorContainerPath), and os.Chown always fails there since Windows has no POSIX
+// uid/gid — CopyDir's uid/gid arguments are consequently a no-op on the Windows copy path.
+package main
+
+import (
+	"archive/tar"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+func main() {
+	dst := flag.String("dst", "", "destination directory to extract into")
+	flag.Parse()
+
+	if *dst == "" {
+		fmt.Fprintln(os.Stderr, "extract: -dst is required")
+		os.Exit(1)
+	}
+
+	if err := run(os.Stdin, *dst); err != nil {
+		fmt.Fprintf(os.Stderr, "extract: %s\n", err)
+		os.Exit(1)
+	}
+}
+
+func run(r io.Reader, dst string) error {
+	tr := tar.NewReader(r)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+
+		target, err := safeJoin(dst, hdr.Name)
+		if err != nil {
+			return err
+		}
+
+		switch hdr.Typeflag {
+		case tar.TypeDir:
+			if err := os.MkdirAll(target, os.FileMode(hdr.Mode)); err != nil {
+				return err
+			}
+			if err := os.Chtimes(target, hdr.ModTime, hdr.ModTime); err != nil {
+				return err
+			}
+		case tar.TypeReg:
+			if err := os.MkdirAll(filepath.Dir(target), 0755); err != nil {
+				return err
+			}
+			f, err := os.OpenFile(target, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, os.FileMode(hdr.Mode))
+			if err != nil {
+				return err
+			}
+			if _, err := io.Copy(f, tr); err != nil {
+				f.Close()
+				return err
+			}
+			if err := f.Close(); err != nil {
+				return err
+			}
+			if err := os.Chtimes(target, hdr.ModTime, hdr.ModTime); err != nil {
+				return err
+			}
+		case tar.TypeSymlink:
+			if filepath.IsAbs(hdr.Linkname) {
+				return fmt.Errorf("symlink '%s' has an absolute target '%s'", hdr.Name, hdr.Linkname)
+			}
+			if _, err := safeJoin(dst, filepath.Join(filepath.Dir(hdr.Name), hdr.Linkname)); err != nil {
+				return fmt.Errorf("symlink '%s' -> '%s': %w", hdr.Name, hdr.Linkname, err)
+			}
+			if err := os.MkdirAll(filepath.Dir(target), 0755); err != nil {
+				return err
+			}
+			if err := os.Symlink(hdr.Linkname, target); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+// safeJoin joins name onto dst and rejects the result if it doesn't stay within dst, guarding against
+// tar entries like "../../windows/system32/foo" writing outside the extraction directory.
+func safeJoin(dst, name string) (string, error) {
+	cleanDst := filepath.Clean(dst)
+	target := filepath.Join(cleanDst, name)
+	if target != cleanDst && !strings.HasPrefix(target, cleanDst+string(filepath.Separator)) {
+		return "", fmt.Errorf("'%s' escapes destination '%s'", name, dst)
+	}
+	return target, nil
+}
@@ -0,0 +1,119 @@
+package build
+
+import (
+	"archive/tar"
+	"bytes"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func buildTar(t *testing.T, entries ...tar.Header) []byte {
+	t.Helper()
+	buf := &bytes.Buffer{}
+	tw := tar.NewWriter(buf)
+	for _, hdr := range entries {
+		hdr := hdr
+		if err := tw.WriteHeader(&hdr); err != nil {
+			t.Fatalf("write tar header: %s", err)
+		}
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatalf("close tar writer: %s", err)
+	}
+	return buf.Bytes()
+}
+
+func TestExtractTar(t *testing.T) {
+	t.Run("extracts a regular file within dst", func(t *testing.T) {
+		dst := t.TempDir()
+		data := buildTar(t, tar.Header{Name: "a.txt", Typeflag: tar.TypeReg, Mode: 0644, Size: 0})
+
+		if err := extractTar(bytes.NewReader(data), dst, nil); err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+		if _, err := os.Stat(filepath.Join(dst, "a.txt")); err != nil {
+			t.Fatalf("want a.txt to exist: %s", err)
+		}
+	})
+
+	t.Run("rejects an entry name that escapes dst", func(t *testing.T) {
+		dst := t.TempDir()
+		data := buildTar(t, tar.Header{Name: "../../etc/passwd", Typeflag: tar.TypeReg, Mode: 0644})
+
+		if err := extractTar(bytes.NewReader(data), dst, nil); err == nil {
+			t.Fatalf("want an error for a path-traversal entry, got none")
+		}
+	})
+
+	t.Run("rejects a symlink with an absolute target", func(t *testing.T) {
+		dst := t.TempDir()
+		data := buildTar(t, tar.Header{Name: "link", Typeflag: tar.TypeSymlink, Linkname: "/etc/passwd", Mode: 0644})
+
+		if err := extractTar(bytes.NewReader(data), dst, nil); err == nil {
+			t.Fatalf("want an error for an absolute symlink target, got none")
+		}
+	})
+
+	t.Run("rejects a symlink whose relative target escapes dst", func(t *testing.T) {
+		dst := t.TempDir()
+		data := buildTar(t, tar.Header{Name: "link", Typeflag: tar.TypeSymlink, Linkname: "../../outside", Mode: 0644})
+
+		if err := extractTar(bytes.NewReader(data), dst, nil); err == nil {
+			t.Fatalf("want an error for an escaping symlink target, got none")
+		}
+	})
+
+	t.Run("allows a symlink whose relative target stays within dst", func(t *testing.T) {
+		dst := t.TempDir()
+		data := buildTar(t,
+			tar.Header{Name: "real.txt", Typeflag: tar.TypeReg, Mode: 0644},
+			tar.Header{Name: "link", Typeflag: tar.TypeSymlink, Linkname: "real.txt", Mode: 0644},
+		)
+
+		if err := extractTar(bytes.NewReader(data), dst, nil); err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+		if _, err := os.Lstat(filepath.Join(dst, "link")); err != nil {
+			t.Fatalf("want link to exist: %s", err)
+		}
+	})
+
+	t.Run("skips entries rejected by fileFilter", func(t *testing.T) {
+		dst := t.TempDir()
+		data := buildTar(t, tar.Header{Name: "skip-me.txt", Typeflag: tar.TypeReg, Mode: 0644})
+
+		err := extractTar(bytes.NewReader(data), dst, func(name string) bool { return false })
+		if err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+		if _, err := os.Stat(filepath.Join(dst, "skip-me.txt")); !os.IsNotExist(err) {
+			t.Fatalf("want skip-me.txt to not exist, got err: %v", err)
+		}
+	})
+}
+
+func TestSafeJoin(t *testing.T) {
+	for _, tc := range []struct {
+		name    string
+		dst     string
+		entry   string
+		wantErr bool
+	}{
+		{name: "plain file", dst: "/dst", entry: "a.txt"},
+		{name: "nested file", dst: "/dst", entry: "a/b.txt"},
+		{name: "parent traversal", dst: "/dst", entry: "../escape", wantErr: true},
+		{name: "nested parent traversal", dst: "/dst", entry: "a/../../escape", wantErr: true},
+	} {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			_, err := safeJoin(tc.dst, tc.entry)
+			if tc.wantErr && err == nil {
+				t.Fatalf("want an error, got none")
+			}
+			if !tc.wantErr && err != nil {
+				t.Fatalf("unexpected error: %s", err)
+			}
+		})
+	}
+}
@@ -0,0 +1,39 @@
+package build
+
+import (
+	"testing"
+
+	dcontainer "github.com/docker/docker/api/types/container"
+)
+
+func TestWindowsCopyOptionsIsolation(t *testing.T) {
+	t.Run("defaults to process isolation when unset", func(t *testing.T) {
+		opts := WindowsCopyOptions{}
+		if got := opts.isolation(); got != dcontainer.IsolationProcess {
+			t.Fatalf("want %q, got %q", dcontainer.IsolationProcess, got)
+		}
+	})
+
+	t.Run("uses the configured isolation when set", func(t *testing.T) {
+		opts := WindowsCopyOptions{Isolation: dcontainer.IsolationHyperV}
+		if got := opts.isolation(); got != dcontainer.IsolationHyperV {
+			t.Fatalf("want %q, got %q", dcontainer.IsolationHyperV, got)
+		}
+	})
+}
+
+func TestWindowsCopyOptionsHelperImage(t *testing.T) {
+	t.Run("falls back to the provided default when unset", func(t *testing.T) {
+		opts := WindowsCopyOptions{}
+		if got := opts.helperImage("builder:latest"); got != "builder:latest" {
+			t.Fatalf("want 'builder:latest', got %q", got)
+		}
+	})
+
+	t.Run("uses the configured helper image when set", func(t *testing.T) {
+		opts := WindowsCopyOptions{HelperImage: "helper:latest"}
+		if got := opts.helperImage("builder:latest"); got != "helper:latest" {
+			t.Fatalf("want 'helper:latest', got %q", got)
+		}
+	})
+}
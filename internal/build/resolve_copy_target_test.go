@@ -0,0 +1,166 @@
+package build
+
+import (
+	"context"
+	"os"
+	"testing"
+
+	"github.com/docker/docker/api/types"
+)
+
+func TestStatContainerPath(t *testing.T) {
+	t.Run("reports an existing path", func(t *testing.T) {
+		fake := &fakeAPIClient{statPaths: map[string]types.ContainerPathStat{
+			`c:\dst`: {Name: "dst", Mode: os.ModeDir},
+		}}
+
+		stat, exists, err := statContainerPath(context.Background(), fake, "container-id", `c:\dst`)
+		if err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+		if !exists {
+			t.Fatalf("want exists=true")
+		}
+		if !stat.Mode.IsDir() {
+			t.Fatalf("want a directory stat, got %v", stat.Mode)
+		}
+	})
+
+	t.Run("treats a missing path as exists=false, not an error", func(t *testing.T) {
+		fake := &fakeAPIClient{}
+
+		_, exists, err := statContainerPath(context.Background(), fake, "container-id", `c:\missing`)
+		if err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+		if exists {
+			t.Fatalf("want exists=false")
+		}
+	})
+}
+
+func TestResolveCopyTarget(t *testing.T) {
+	t.Run("returns dst itself when dst is already a directory", func(t *testing.T) {
+		fake := &fakeAPIClient{statPaths: map[string]types.ContainerPathStat{
+			`c:\dst`: {Mode: os.ModeDir},
+		}}
+
+		got, err := resolveCopyTarget(context.Background(), fake, "container-id", `c:\dst`)
+		if err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+		if got != `c:\dst` {
+			t.Fatalf("want 'c:\\dst', got %q", got)
+		}
+	})
+
+	t.Run("returns dst's parent when dst is an existing file", func(t *testing.T) {
+		fake := &fakeAPIClient{statPaths: map[string]types.ContainerPathStat{
+			`c:\dst\stack.toml`: {Mode: 0},
+		}}
+
+		got, err := resolveCopyTarget(context.Background(), fake, "container-id", `c:\dst\stack.toml`)
+		if err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+		if got != `c:\dst` {
+			t.Fatalf("want 'c:\\dst', got %q", got)
+		}
+	})
+
+	t.Run("falls back to dst's parent when dst does not exist yet but its parent does", func(t *testing.T) {
+		fake := &fakeAPIClient{statPaths: map[string]types.ContainerPathStat{
+			`c:\dst`: {Mode: os.ModeDir},
+		}}
+
+		got, err := resolveCopyTarget(context.Background(), fake, "container-id", `c:\dst\new.toml`)
+		if err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+		if got != `c:\dst` {
+			t.Fatalf("want 'c:\\dst', got %q", got)
+		}
+	})
+
+	t.Run("errors when neither dst nor its parent exist", func(t *testing.T) {
+		fake := &fakeAPIClient{}
+
+		if _, err := resolveCopyTarget(context.Background(), fake, "container-id", `c:\dst\new.toml`); err == nil {
+			t.Fatalf("want an error, got none")
+		}
+	})
+}
+
+func TestContainerPathMatchesContent(t *testing.T) {
+	t.Run("matches an existing file with identical content", func(t *testing.T) {
+		fake := &fakeAPIClient{
+			statPaths:    map[string]types.ContainerPathStat{`c:\dst\stack.toml`: {Size: 5}},
+			fileContents: map[string][]byte{`c:\dst\stack.toml`: []byte("hello")},
+		}
+
+		match, err := containerPathMatchesContent(context.Background(), fake, "container-id", `c:\dst\stack.toml`, []byte("hello"))
+		if err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+		if !match {
+			t.Fatalf("want a match")
+		}
+	})
+
+	t.Run("does not match same-size content that actually differs", func(t *testing.T) {
+		fake := &fakeAPIClient{
+			statPaths:    map[string]types.ContainerPathStat{`c:\dst\stack.toml`: {Size: 5}},
+			fileContents: map[string][]byte{`c:\dst\stack.toml`: []byte("goodbye-old")[:5]},
+		}
+
+		match, err := containerPathMatchesContent(context.Background(), fake, "container-id", `c:\dst\stack.toml`, []byte("hello"))
+		if err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+		if match {
+			t.Fatalf("want no match for content that differs despite the same size")
+		}
+	})
+
+	t.Run("does not match when the size differs, without reading the file back", func(t *testing.T) {
+		fake := &fakeAPIClient{
+			statPaths: map[string]types.ContainerPathStat{`c:\dst\stack.toml`: {Size: 41}},
+			// Reading the file back would find matching content, so a match here means it was read.
+			fileContents: map[string][]byte{`c:\dst\stack.toml`: []byte("hello")},
+		}
+
+		match, err := containerPathMatchesContent(context.Background(), fake, "container-id", `c:\dst\stack.toml`, []byte("hello"))
+		if err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+		if match {
+			t.Fatalf("want no match")
+		}
+	})
+
+	t.Run("does not match a directory", func(t *testing.T) {
+		fake := &fakeAPIClient{statPaths: map[string]types.ContainerPathStat{
+			`c:\dst`: {Mode: os.ModeDir, Size: 5},
+		}}
+
+		match, err := containerPathMatchesContent(context.Background(), fake, "container-id", `c:\dst`, []byte("hello"))
+		if err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+		if match {
+			t.Fatalf("want no match for a directory")
+		}
+	})
+
+	t.Run("does not match when the path does not exist", func(t *testing.T) {
+		fake := &fakeAPIClient{}
+
+		match, err := containerPathMatchesContent(context.Background(), fake, "container-id", `c:\missing`, nil)
+		if err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+		if match {
+			t.Fatalf("want no match for a missing path")
+		}
+	})
+}